@@ -0,0 +1,62 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pearsonk/ghw/pkg/snapshot"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s diff <base> <new> [outfile]\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "  writes a tarball of <new>'s content that differs from <base>, for use")
+	fmt.Fprintln(os.Stderr, "  as a BasePaths layer on top of <base>. Files deleted in <new> relative")
+	fmt.Fprintln(os.Stderr, "  to <base> are recorded as whiteout markers and removed on unpack.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "diff":
+		if err := runDiff(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+// runDiff implements the "diff" subcommand: it writes a tarball containing
+// only the files under <new> that are absent from, or differ from, <base>,
+// suitable for use as a BasePaths layer on top of <base>.
+func runDiff(args []string) error {
+	if len(args) < 2 {
+		usage()
+		return fmt.Errorf("ghw-snapshot diff: <base> and <new> are required")
+	}
+	base, newDir := args[0], args[1]
+
+	out := os.Stdout
+	if len(args) >= 3 {
+		f, err := os.Create(args[2])
+		if err != nil {
+			return fmt.Errorf("ghw-snapshot diff: unable to create %q: %w", args[2], err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return snapshot.Diff(base, newDir, out)
+}
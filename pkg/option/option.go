@@ -6,7 +6,11 @@
 
 package option
 
-import "os"
+import (
+	"context"
+	"io"
+	"os"
+)
 
 const (
 	defaultChroot           = "/"
@@ -63,6 +67,39 @@ func EnvOrDefaultSnapshotPreserve() bool {
 	return false
 }
 
+// Logger is the minimal logging interface ghw needs from a caller-supplied
+// logger implementation. It is deliberately small so that adapting most
+// logging libraries (or none at all) is a one-liner.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger discards everything written to it. It is the default Logger for
+// an Option that doesn't configure one, so callers that never call
+// WithLogger see ghw neither write to their own package-level logger nor
+// panic on a nil Logger.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// NopLogger is the no-op Logger that Merge installs on an Option whose
+// Logger was left unset.
+var NopLogger Logger = nopLogger{}
+
+// SnapshotFetcher knows how to retrieve the raw bytes of a snapshot layer
+// given a scheme-qualified reference, e.g. a local path, an http(s):// URL,
+// or an oci://registry/repo:tag artifact reference. Implementations are
+// looked up by the ref's URL scheme; see WithSnapshotFetcher.
+type SnapshotFetcher interface {
+	Fetch(ctx context.Context, ref string) (io.ReadCloser, error)
+}
+
 // Option is used to represent optionally-configured settings. Each field is a
 // pointer to some concrete value so that we can tell when something has been
 // set or left unset.
@@ -78,6 +115,15 @@ type Option struct {
 
 	// Snapshot contains options for handling ghw snapshots
 	Snapshot *SnapshotOptions
+
+	// Context is threaded through long-running ghw operations (snapshot
+	// unpacking, sysfs walking) so that callers embedding ghw can cancel or
+	// time out a probe.
+	Context context.Context
+
+	// Logger receives ghw's debug/info/warn/error output instead of ghw's
+	// package-level logger, if set.
+	Logger Logger
 }
 
 // SnapshotOptions contains options for handling of ghw snapshots
@@ -85,9 +131,14 @@ type SnapshotOptions struct {
 	// Path allows users to specify a snapshot (captured using ghw-snapshot) to be
 	// automatically consumed. Users need to supply the path of the snapshot, and
 	// ghw will take care of unpacking it on a temporary directory.
-	// Set the environment variable "GHW_SNAPSHOT_PRESERVE" to make ghw skip the cleanup
-	// stage and keep the unpacked snapshot in the temporary directory.
 	Path string
+	// BasePaths holds an ordered stack of snapshots this snapshot is layered
+	// on top of, lowest layer first. When set, the unpacker unpacks each base
+	// layer in order and then Path on top, so that files in Path (and higher
+	// BasePaths entries) shadow files from lower ones. This lets a snapshot
+	// capture only the delta against a shared "golden" base instead of a full
+	// tree every time.
+	BasePaths []string
 	// Root is the directory on which the snapshot must be unpacked. This allows
 	// the users to manage their snapshot directory instead of ghw doing that on
 	// their behalf. Relevant only if SnapshotPath is given.
@@ -99,45 +150,216 @@ type SnapshotOptions struct {
 	// As additional side effect, give both this option and SnapshotRoot to make each
 	// context try to unpack the snapshot only once.
 	Exclusive bool
+	// Preserve tells ghw to skip the cleanup stage and keep the unpacked snapshot
+	// in the temporary (or given Root) directory around after the run. Previously
+	// this was only reachable via the GHW_SNAPSHOT_PRESERVE environ variable; it
+	// is now also exposed as a first-class option for callers that compose their
+	// own option sets.
+	Preserve bool
+	// Fetchers overrides, by URL scheme, the SnapshotFetcher used to retrieve
+	// Path and BasePaths entries bearing that scheme for this call only. Built
+	// in fetchers already handle bare paths, file://, http(s):// and
+	// (anonymous pulls only) oci://; use this to add e.g. an
+	// internal-artifact-server scheme, or to replace a built-in fetcher
+	// outright.
+	Fetchers map[string]SnapshotFetcher
 }
 
-func WithChroot(dir string) *Option {
-	return &Option{Chroot: &dir}
+// OptionFunc mutates an *Option in place. It is the building block of ghw's
+// functional-option API: every public With* helper returns an OptionFunc, and
+// OptionFuncs are combined with Compose.
+type OptionFunc func(*Option) error
+
+// Compose threads a single *Option through each of the given OptionFuncs, in
+// order, returning the first error encountered (if any). The returned
+// OptionFunc can itself be passed to Compose, so callers can build up and
+// share reusable option sets, e.g.:
+//
+//	withHostDefaults := option.Compose(
+//		option.WithChroot("/host"),
+//		option.WithSnapshotRoot("/var/cache/ghw"),
+//	)
+func Compose(fns ...OptionFunc) OptionFunc {
+	return func(opt *Option) error {
+		for _, fn := range fns {
+			if fn == nil {
+				continue
+			}
+			if err := fn(opt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// FromStruct adapts a pre-built *Option into an OptionFunc, so that callers
+// still holding onto the old struct-pointer style can migrate incrementally.
+func FromStruct(o *Option) OptionFunc {
+	return func(opt *Option) error {
+		if o == nil {
+			return nil
+		}
+		if o.Chroot != nil {
+			opt.Chroot = o.Chroot
+		}
+		if o.Snapshot != nil {
+			opt.Snapshot = o.Snapshot
+		}
+		if o.Context != nil {
+			opt.Context = o.Context
+		}
+		if o.Logger != nil {
+			opt.Logger = o.Logger
+		}
+		return nil
+	}
+}
+
+// WithChroot sets the Chroot option
+func WithChroot(dir string) OptionFunc {
+	return func(opt *Option) error {
+		opt.Chroot = &dir
+		return nil
+	}
 }
 
 // WithSnapshot sets snapshot-processing options for a ghw run
-func WithSnapshot(opts SnapshotOptions) *Option {
-	return &Option{
-		Snapshot: &opts,
+func WithSnapshot(opts SnapshotOptions) OptionFunc {
+	return func(opt *Option) error {
+		opt.Snapshot = &opts
+		return nil
 	}
 }
 
-// There is intentionally no Option related to GHW_SNAPSHOT_PRESERVE because we see that as
-// a debug/troubleshoot aid more something users wants to do regularly.
-// Hence we allow that only via the environment variable for the time being.
+// withSnapshotOptions returns opt.Snapshot, allocating it first if this is
+// the first SnapshotOptions-related OptionFunc applied.
+func withSnapshotOptions(opt *Option) *SnapshotOptions {
+	if opt.Snapshot == nil {
+		opt.Snapshot = &SnapshotOptions{}
+	}
+	return opt.Snapshot
+}
 
-func Merge(opts ...*Option) *Option {
-	merged := &Option{}
-	for _, opt := range opts {
-		if opt.Chroot != nil {
-			merged.Chroot = opt.Chroot
-		}
-		if opt.Snapshot != nil {
-			merged.Snapshot = opt.Snapshot
+// WithSnapshotPath sets the Path field of the snapshot options, leaving any
+// other previously-set snapshot options untouched.
+func WithSnapshotPath(path string) OptionFunc {
+	return func(opt *Option) error {
+		withSnapshotOptions(opt).Path = path
+		return nil
+	}
+}
+
+// WithSnapshotRoot sets the Root field of the snapshot options, leaving any
+// other previously-set snapshot options untouched.
+func WithSnapshotRoot(root string) OptionFunc {
+	return func(opt *Option) error {
+		withSnapshotOptions(opt).Root = &root
+		return nil
+	}
+}
+
+// WithSnapshotBasePaths sets the BasePaths field of the snapshot options,
+// ordered from lowest to highest layer, leaving any other previously-set
+// snapshot options untouched.
+func WithSnapshotBasePaths(basePaths ...string) OptionFunc {
+	return func(opt *Option) error {
+		withSnapshotOptions(opt).BasePaths = basePaths
+		return nil
+	}
+}
+
+// WithSnapshotFetcher registers f as the SnapshotFetcher used to retrieve
+// Path/BasePaths entries whose URL scheme is scheme, for this call only.
+func WithSnapshotFetcher(scheme string, f SnapshotFetcher) OptionFunc {
+	return func(opt *Option) error {
+		so := withSnapshotOptions(opt)
+		if so.Fetchers == nil {
+			so.Fetchers = map[string]SnapshotFetcher{}
 		}
+		so.Fetchers[scheme] = f
+		return nil
+	}
+}
+
+// WithSnapshotExclusive sets the Exclusive field of the snapshot options,
+// leaving any other previously-set snapshot options untouched.
+func WithSnapshotExclusive(exclusive bool) OptionFunc {
+	return func(opt *Option) error {
+		withSnapshotOptions(opt).Exclusive = exclusive
+		return nil
+	}
+}
+
+// WithSnapshotPreserve sets the Preserve field of the snapshot options,
+// leaving any other previously-set snapshot options untouched.
+func WithSnapshotPreserve(preserve bool) OptionFunc {
+	return func(opt *Option) error {
+		withSnapshotOptions(opt).Preserve = preserve
+		return nil
+	}
+}
+
+// WithContext sets the Context that long-running ghw operations observe for
+// cancellation.
+func WithContext(ctx context.Context) OptionFunc {
+	return func(opt *Option) error {
+		opt.Context = ctx
+		return nil
+	}
+}
+
+// WithLogger sets the Logger that ghw writes its debug/info/warn/error
+// output to, instead of ghw's package-level logger.
+func WithLogger(l Logger) OptionFunc {
+	return func(opt *Option) error {
+		opt.Logger = l
+		return nil
+	}
+}
+
+// Merge applies Compose(opts...) against a freshly-allocated Option and fills
+// in any field left unset from the environment (or, for Context and Logger,
+// from a background/no-op default). Note that Merge's signature changed
+// along with the rest of the functional-option API (it now takes
+// ...OptionFunc and returns an error alongside the *Option); callers still
+// holding a pre-built *Option from the old struct-pointer API should wrap it
+// with FromStruct rather than expect Merge itself to accept it.
+func Merge(opts ...OptionFunc) (*Option, error) {
+	merged := &Option{}
+	if err := Compose(opts...)(merged); err != nil {
+		return nil, err
 	}
-	// Set the default value if missing from mergeOpts
 	if merged.Chroot == nil {
 		chroot := EnvOrDefaultChroot()
 		merged.Chroot = &chroot
 	}
+	// Fill in each snapshot field left unset from the environment
+	// individually, rather than only when Snapshot is nil outright: a caller
+	// who sets e.g. Path via WithSnapshotPath but leaves Root/Exclusive/
+	// Preserve untouched should still pick up GHW_SNAPSHOT_ROOT,
+	// GHW_SNAPSHOT_EXCLUSIVE and GHW_SNAPSHOT_PRESERVE for those.
 	if merged.Snapshot == nil {
+		merged.Snapshot = &SnapshotOptions{}
+	}
+	if merged.Snapshot.Path == "" {
+		merged.Snapshot.Path = EnvOrDefaultSnapshotPath()
+	}
+	if merged.Snapshot.Root == nil {
 		snapRoot := EnvOrDefaultSnapshotRoot()
-		merged.Snapshot = &SnapshotOptions{
-			Path:      EnvOrDefaultSnapshotPath(),
-			Root:      &snapRoot,
-			Exclusive: EnvOrDefaultSnapshotExclusive(),
-		}
+		merged.Snapshot.Root = &snapRoot
+	}
+	if !merged.Snapshot.Exclusive {
+		merged.Snapshot.Exclusive = EnvOrDefaultSnapshotExclusive()
+	}
+	if !merged.Snapshot.Preserve {
+		merged.Snapshot.Preserve = EnvOrDefaultSnapshotPreserve()
+	}
+	if merged.Context == nil {
+		merged.Context = context.Background()
+	}
+	if merged.Logger == nil {
+		merged.Logger = NopLogger
 	}
-	return merged
+	return merged, nil
 }
@@ -0,0 +1,209 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// whiteoutPrefix marks a tar entry as recording the deletion of the sibling
+// entry with the same name, minus this prefix, from a lower layer - the same
+// role AUFS/overlay whiteout files play, scoped to ghw's own layer format so
+// it never collides with a name a real snapshot could contain. copyTree
+// interprets it when merging a layer that carries one.
+const whiteoutPrefix = ".ghw-wh."
+
+// Diff walks newDir and writes a tar, compressed with gzip, to w containing
+// the files that are new or whose size or content differs from the
+// corresponding file in baseDir, plus a whiteout marker for every file (or
+// directory) present in baseDir but absent from newDir. The resulting
+// tarball is suitable as a BasePaths layer on top of base: unpacking base
+// followed by the diff reproduces newDir, deletions included.
+func Diff(baseDir, newDir string, w io.Writer) error {
+	gzw := gzip.NewWriter(w)
+	defer gzw.Close()
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	if err := filepath.Walk(newDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(newDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		changed, err := differsFromBase(baseDir, path, rel, info)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if newInfo, err := os.Lstat(filepath.Join(newDir, rel)); err == nil {
+			if info.IsDir() && !newInfo.IsDir() {
+				// The directory became a non-directory in newDir, whose
+				// entry replaces the whole subtree on unpack; its children
+				// need no markers of their own.
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := writeWhiteout(tw, rel); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// The whole subtree is gone from newDir; one marker for the
+			// directory covers it without one redundant marker per child.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// writeWhiteout writes a zero-length tar entry recording the deletion of
+// rel from a lower layer.
+func writeWhiteout(tw *tar.Writer, rel string) error {
+	dir, base := filepath.Split(rel)
+	hdr := &tar.Header{
+		Name:     filepath.Join(dir, whiteoutPrefix+base),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}
+	return tw.WriteHeader(hdr)
+}
+
+// differsFromBase reports whether the entry at rel (path in newDir, and
+// described by info from newDir) is absent from baseDir or differs from it
+// by size or, failing that, by actual content.
+func differsFromBase(baseDir, path, rel string, info os.FileInfo) (bool, error) {
+	basePath := filepath.Join(baseDir, rel)
+	baseInfo, err := os.Lstat(basePath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("snapshot: unable to stat base entry %q: %w", rel, err)
+	}
+	isSymlink := info.Mode()&os.ModeSymlink != 0
+	baseIsSymlink := baseInfo.Mode()&os.ModeSymlink != 0
+	if info.IsDir() != baseInfo.IsDir() || isSymlink != baseIsSymlink {
+		return true, nil
+	}
+	if info.IsDir() {
+		return false, nil
+	}
+	if isSymlink {
+		// A symlink's "content" is its target, not the file it points at -
+		// opening through it (as contentDiffers does) would follow it, and
+		// the relative targets that fill a sysfs tree resolve against the
+		// process's CWD rather than the symlink's own directory, failing
+		// ENOENT for an unchanged link.
+		newTarget, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		baseTarget, err := os.Readlink(basePath)
+		if err != nil {
+			return false, err
+		}
+		return newTarget != baseTarget, nil
+	}
+	if info.Size() != baseInfo.Size() {
+		return true, nil
+	}
+	return contentDiffers(path, basePath)
+}
+
+// contentDiffers reports whether the (same-size) regular files at newPath
+// and basePath have different content.
+func contentDiffers(newPath, basePath string) (bool, error) {
+	newF, err := os.Open(newPath)
+	if err != nil {
+		return false, err
+	}
+	defer newF.Close()
+	baseF, err := os.Open(basePath)
+	if err != nil {
+		return false, err
+	}
+	defer baseF.Close()
+
+	const chunkSize = 64 * 1024
+	newBuf := make([]byte, chunkSize)
+	baseBuf := make([]byte, chunkSize)
+	for {
+		nn, nerr := io.ReadFull(newF, newBuf)
+		bn, berr := io.ReadFull(baseF, baseBuf)
+		if !bytes.Equal(newBuf[:nn], baseBuf[:bn]) {
+			return true, nil
+		}
+		if nerr == io.EOF && berr == io.EOF {
+			return false, nil
+		}
+		if nerr != nil && nerr != io.ErrUnexpectedEOF {
+			return false, nerr
+		}
+		if berr != nil && berr != io.ErrUnexpectedEOF {
+			return false, berr
+		}
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDiffRoundTrip builds a base tree and a new tree derived from it (an
+// unchanged file, a changed file, an added file, a deleted file, and an
+// unchanged symlink), diffs them, then replays base + diff through the same
+// extractTarTo/copyTree path Unpack uses and checks the result matches new.
+func TestDiffRoundTrip(t *testing.T) {
+	base := t.TempDir()
+	newDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(base, "unchanged.txt"), "same")
+	mustWriteFile(t, filepath.Join(base, "changed.txt"), "before")
+	mustWriteFile(t, filepath.Join(base, "deleted.txt"), "gone-soon")
+	if err := os.Symlink("unchanged.txt", filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, filepath.Join(newDir, "unchanged.txt"), "same")
+	mustWriteFile(t, filepath.Join(newDir, "changed.txt"), "after")
+	mustWriteFile(t, filepath.Join(newDir, "added.txt"), "new")
+	if err := os.Symlink("unchanged.txt", filepath.Join(newDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var diffTar bytes.Buffer
+	if err := Diff(base, newDir, &diffTar); err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	merged := t.TempDir()
+	if err := copyTree(base, merged); err != nil {
+		t.Fatalf("copyTree(base): %v", err)
+	}
+
+	layerDir := t.TempDir()
+	if err := extractTarTo(context.Background(), bytes.NewReader(diffTar.Bytes()), layerDir); err != nil {
+		t.Fatalf("extractTarTo: %v", err)
+	}
+	if err := copyTree(layerDir, merged); err != nil {
+		t.Fatalf("copyTree(diff): %v", err)
+	}
+
+	assertFileContent(t, filepath.Join(merged, "unchanged.txt"), "same")
+	assertFileContent(t, filepath.Join(merged, "changed.txt"), "after")
+	assertFileContent(t, filepath.Join(merged, "added.txt"), "new")
+	if _, err := os.Lstat(filepath.Join(merged, "deleted.txt")); !os.IsNotExist(err) {
+		t.Fatalf("deleted.txt: want removed by whiteout, got err=%v", err)
+	}
+	target, err := os.Readlink(filepath.Join(merged, "link"))
+	if err != nil {
+		t.Fatalf("Readlink(link): %v", err)
+	}
+	if target != "unchanged.txt" {
+		t.Fatalf("link target = %q, want %q", target, "unchanged.txt")
+	}
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s content = %q, want %q", path, got, want)
+	}
+}
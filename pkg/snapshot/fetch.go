@@ -0,0 +1,318 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pearsonk/ghw/pkg/option"
+)
+
+// registryMu guards registry, the process-wide set of built-in fetchers.
+// opts.Fetchers (set via option.WithSnapshotFetcher) always takes priority
+// over it and is consulted first in fetcherFor.
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]option.SnapshotFetcher{}
+)
+
+// defaultHTTPCacheDir is where the registry's built-in http(s) fetcher
+// caches ETags and bodies when a call doesn't go through Unpack (which
+// gives the http(s) fetcher it constructs its own, call-scoped cache dir
+// instead; see fetchersFor). It's a fixed path, not a mutated global: every
+// reader of it sees the same value for the life of the process.
+var defaultHTTPCacheDir = filepath.Join(os.TempDir(), "ghw-snapshot-http-cache")
+
+func init() {
+	registry["file"] = fileFetcher{}
+	h := newHTTPFetcher(defaultHTTPCacheDir)
+	registry["http"] = h
+	registry["https"] = h
+	registry["oci"] = ociFetcher{client: http.DefaultClient}
+}
+
+// Register installs f as the process-wide built-in fetcher for scheme,
+// replacing any previous built-in for that scheme. Prefer
+// option.WithSnapshotFetcher to scope a custom fetcher to a single ghw
+// call; use Register only when every caller in the process should pick up
+// the new fetcher.
+func Register(scheme string, f option.SnapshotFetcher) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[scheme] = f
+}
+
+// fetcherFor returns the SnapshotFetcher that should handle scheme for this
+// call: opts.Fetchers[scheme] if set, falling back to the built-in registry.
+func fetcherFor(opts *option.SnapshotOptions, scheme string) (option.SnapshotFetcher, error) {
+	if opts != nil {
+		if f, ok := opts.Fetchers[scheme]; ok {
+			return f, nil
+		}
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if f, ok := registry[scheme]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("snapshot: no fetcher registered for scheme %q", scheme)
+}
+
+// fetchersFor returns the full scheme -> SnapshotFetcher map to use for one
+// Unpack call: the process-wide registry (including anything installed with
+// Register), with its built-in http(s) fetcher swapped for a call-scoped
+// one pointed at cacheDir (so concurrent Unpack calls with different roots
+// never share, and race on, the same on-disk ETag/body cache), overridden by
+// anything the caller already set in overrides via
+// option.WithSnapshotFetcher.
+func fetchersFor(cacheDir string, overrides map[string]option.SnapshotFetcher) map[string]option.SnapshotFetcher {
+	h := newHTTPFetcher(cacheDir)
+	merged := map[string]option.SnapshotFetcher{}
+	registryMu.RLock()
+	for scheme, f := range registry {
+		if _, builtin := f.(*httpFetcher); builtin {
+			f = h
+		}
+		merged[scheme] = f
+	}
+	registryMu.RUnlock()
+	for scheme, f := range overrides {
+		merged[scheme] = f
+	}
+	return merged
+}
+
+// schemeOf returns ref's URL scheme, defaulting to "file" for bare
+// filesystem paths that don't carry one.
+func schemeOf(ref string) string {
+	if i := strings.Index(ref, "://"); i > 0 {
+		return ref[:i]
+	}
+	return "file"
+}
+
+// fileFetcher fetches snapshots from the local filesystem. It is the
+// default fetcher for bare paths and file:// URLs.
+type fileFetcher struct{}
+
+func (fileFetcher) Fetch(ctx context.Context, ref string) (io.ReadCloser, error) {
+	path := ref
+	if strings.HasPrefix(ref, "file://") {
+		path = strings.TrimPrefix(ref, "file://")
+	}
+	return os.Open(path)
+}
+
+// httpFetcher fetches snapshots over http(s), sending an If-None-Match
+// request conditioned on any ETag cached from a previous fetch of the same
+// ref, and serving the matching cached body on a 304 response. cacheDir is
+// fixed at construction time (see newHTTPFetcher) rather than a package
+// global, so that two httpFetchers - e.g. ones built for two concurrent
+// Unpack calls with different Root directories - never share, and race on,
+// the same on-disk cache.
+type httpFetcher struct {
+	client   *http.Client
+	cacheDir string
+}
+
+func newHTTPFetcher(cacheDir string) *httpFetcher {
+	return &httpFetcher{client: http.DefaultClient, cacheDir: cacheDir}
+}
+
+func (f *httpFetcher) etagPath(ref string) string {
+	return filepath.Join(f.cacheDir, "http", sha256hex([]byte(ref))+".etag")
+}
+
+func (f *httpFetcher) bodyPath(ref string) string {
+	return filepath.Join(f.cacheDir, "http", sha256hex([]byte(ref))+".body")
+}
+
+func (f *httpFetcher) Fetch(ctx context.Context, ref string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	haveCachedBody := false
+	if etag, err := os.ReadFile(f.etagPath(ref)); err == nil {
+		if _, err := os.Stat(f.bodyPath(ref)); err == nil {
+			req.Header.Set("If-None-Match", string(etag))
+			haveCachedBody = true
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if !haveCachedBody {
+			// Shouldn't happen - we only sent If-None-Match when we already
+			// have a cached body - but fall back to a plain re-fetch rather
+			// than fail outright if the cache was removed from under us.
+			req.Header.Del("If-None-Match")
+			resp2, err := f.client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp2.Body.Close()
+			if resp2.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("snapshot: GET %s: unexpected status %s", ref, resp2.Status)
+			}
+			return f.store(ref, resp2)
+		}
+		return os.Open(f.bodyPath(ref))
+	case http.StatusOK:
+		return f.store(ref, resp)
+	default:
+		return nil, fmt.Errorf("snapshot: GET %s: unexpected status %s", ref, resp.Status)
+	}
+}
+
+// store writes resp's body to this ref's cache file, records its ETag (if
+// any), and returns a fresh, independent reader of the cached file.
+func (f *httpFetcher) store(ref string, resp *http.Response) (io.ReadCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(f.bodyPath(ref)), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.bodyPath(ref)), "body-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), f.bodyPath(ref)); err != nil {
+		return nil, err
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		_ = os.WriteFile(f.etagPath(ref), []byte(etag), 0644)
+	} else {
+		// No ETag means we can never safely send If-None-Match for this ref
+		// again, so remove any stale one from a previous fetch rather than
+		// leave it implying the freshly-cached body can still be validated.
+		os.Remove(f.etagPath(ref))
+	}
+	return os.Open(f.bodyPath(ref))
+}
+
+// ociManifest is the minimal subset of the OCI image manifest schema
+// (https://github.com/opencontainers/image-spec) this fetcher needs: enough
+// to find the single content layer of a single-layer OCI artifact.
+type ociManifest struct {
+	Layers []struct {
+		Digest    string `json:"digest"`
+		MediaType string `json:"mediaType"`
+	} `json:"layers"`
+}
+
+// ociFetcher pulls a single-layer OCI artifact (e.g. a ghw snapshot pushed
+// to a registry with `oras push`) anonymously over the OCI Distribution
+// HTTP API; refs look like "oci://registry/repo:tag".
+//
+// It sends no Authorization header and never walks the
+// WWW-Authenticate/bearer-token challenge flow, so it only works against a
+// registry that serves GET /v2/.../manifests and /v2/.../blobs to anonymous
+// requests. Most real-world registries - ghcr.io and Docker Hub included -
+// require a bearer token even for anonymous pulls, so fetching from them
+// with this fetcher fails with a 401. It does not support multi-layer
+// images either. Use option.WithSnapshotFetcher to supply a fetcher that
+// performs the challenge flow (or otherwise attaches credentials) against
+// such a registry.
+type ociFetcher struct {
+	client *http.Client
+}
+
+func (f ociFetcher) Fetch(ctx context.Context, ref string) (io.ReadCloser, error) {
+	registryHost, repo, reference, err := parseOCIRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost, repo, reference)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("snapshot: GET %s: unexpected status %s", manifestURL, resp.Status)
+	}
+
+	var manifest ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("snapshot: unable to decode OCI manifest for %q: %w", ref, err)
+	}
+	if len(manifest.Layers) != 1 {
+		return nil, fmt.Errorf("snapshot: %q is not a single-layer OCI artifact (found %d layers)", ref, len(manifest.Layers))
+	}
+
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", registryHost, repo, manifest.Layers[0].Digest)
+	blobReq, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	blobResp, err := f.client.Do(blobReq)
+	if err != nil {
+		return nil, err
+	}
+	if blobResp.StatusCode != http.StatusOK {
+		blobResp.Body.Close()
+		return nil, fmt.Errorf("snapshot: GET %s: unexpected status %s", blobURL, blobResp.Status)
+	}
+	return blobResp.Body, nil
+}
+
+// parseOCIRef splits "oci://registry.example.com/repo/name:tag" into its
+// registry host, repository, and tag (or digest) reference.
+func parseOCIRef(ref string) (registryHost, repo, reference string, err error) {
+	trimmed := strings.TrimPrefix(ref, "oci://")
+	u, parseErr := url.Parse("oci://" + trimmed)
+	if parseErr != nil {
+		return "", "", "", fmt.Errorf("snapshot: invalid oci ref %q: %w", ref, parseErr)
+	}
+	registryHost = u.Host
+	path := strings.TrimPrefix(u.Path, "/")
+
+	reference = "latest"
+	if at := strings.LastIndex(path, "@"); at >= 0 {
+		repo, reference = path[:at], path[at+1:]
+	} else if colon := strings.LastIndex(path, ":"); colon >= 0 {
+		repo, reference = path[:colon], path[colon+1:]
+	} else {
+		repo = path
+	}
+	if registryHost == "" || repo == "" {
+		return "", "", "", fmt.Errorf("snapshot: invalid oci ref %q: expected oci://registry/repo[:tag]", ref)
+	}
+	return registryHost, repo, reference, nil
+}
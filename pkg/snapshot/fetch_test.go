@@ -0,0 +1,71 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHTTPFetcherConditionalGet exercises the If-None-Match/304 path: a
+// first fetch stores the ETag and body, a second fetch sends If-None-Match
+// and, on a 304 response, must serve the previously-cached body rather than
+// error or return an empty result.
+func TestHTTPFetcherConditionalGet(t *testing.T) {
+	const body = "snapshot-bytes"
+	var requests, conditional int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	f := newHTTPFetcher(t.TempDir())
+
+	rc, err := f.Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("read first fetch: %v", err)
+	}
+	if !bytes.Equal(got, []byte(body)) {
+		t.Fatalf("first fetch body = %q, want %q", got, body)
+	}
+
+	rc, err = f.Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("second fetch: %v", err)
+	}
+	got, err = io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("read second fetch: %v", err)
+	}
+	if !bytes.Equal(got, []byte(body)) {
+		t.Fatalf("second fetch body = %q, want cached %q", got, body)
+	}
+
+	if requests != 2 {
+		t.Fatalf("requests = %d, want 2", requests)
+	}
+	if conditional != 1 {
+		t.Fatalf("conditional (304) requests = %d, want 1", conditional)
+	}
+}
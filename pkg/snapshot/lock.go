@@ -0,0 +1,65 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockPath acquires an exclusive, cross-process advisory lock (flock(2)) on
+// a dedicated lock file, so that parallel ghw processes don't race on
+// populating whatever path the lock guards. Unlike a create-exclusive
+// marker file, this lock is released by the kernel the moment the holding
+// process's file descriptor is closed, including on a crash - so a process
+// dying mid-unpack can never leave a stale lock behind to deadlock future
+// callers. The returned unlock function releases the lock and closes the
+// underlying file descriptor; it must be called once the caller is done,
+// whether or not it ended up doing the work the lock guards.
+//
+// ctx is honored while waiting for a lock held by someone else: a slow
+// probe blocked on a contended lock can still be cancelled.
+func lockPath(ctx context.Context, lockFile string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(lockFile), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// syscall.Flock's blocking mode has no way to interrupt it directly, so
+	// run it on its own goroutine and race it against ctx. If ctx wins, the
+	// goroutine is left to acquire (and immediately release) the lock on
+	// its own time; it holds no resources the caller can see meanwhile.
+	done := make(chan error, 1)
+	go func() { done <- syscall.Flock(int(f.Fd()), syscall.LOCK_EX) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("snapshot: unable to lock %q: %w", lockFile, err)
+		}
+		return func() {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			f.Close()
+		}, nil
+	case <-ctx.Done():
+		go func() {
+			if err := <-done; err == nil {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			}
+			f.Close()
+		}()
+		return nil, ctx.Err()
+	}
+}
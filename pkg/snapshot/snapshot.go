@@ -0,0 +1,473 @@
+//
+// Use and distribution licensed under the Apache license version 2.
+//
+// See the COPYING file in the root project directory for full text.
+//
+
+// Package snapshot knows how to unpack the tarballs produced by
+// ghw-snapshot into a directory tree that ghw's probers can chroot into.
+package snapshot
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pearsonk/ghw/pkg/option"
+)
+
+// lockSuffix is appended to the path being locked to get the path of its
+// lock file.
+const lockSuffix = ".lock"
+
+// Unpack unpacks the snapshot described by opt.Snapshot into a single merged
+// directory and returns its path. If opt.Snapshot.BasePaths is non-empty,
+// each base layer is unpacked in order (lowest first) before Path, so that
+// files in higher layers shadow files from lower ones.
+//
+// Each layer is unpacked into its own content-addressed directory in the
+// layer cache (see cacheRoot), keyed by a hash of the layer's tarball
+// contents. Layers are only
+// unpacked once: if the hash directory already exists (because this or a
+// prior ghw process already unpacked that exact layer), it is reused as-is.
+// The merged directory is then assembled by copying each layer's contents
+// over the merged tree in order.
+//
+// opt.Context is checked for cancellation between layers, and opt.Logger (if
+// set) receives debug-level progress messages; both default sensibly if opt
+// was not built via option.Merge.
+func Unpack(opt *option.Option) (string, error) {
+	opts := opt.Snapshot
+	if opts == nil || opts.Path == "" {
+		return "", fmt.Errorf("snapshot: no Path given to unpack")
+	}
+	ctx, logger := contextAndLogger(opt)
+	root := snapshotRoot(opts)
+	cache := cacheRoot(root, opts)
+
+	layers := append(append([]string{}, opts.BasePaths...), opts.Path)
+
+	// Give the http(s) fetcher a cache dir scoped to this call's own cache
+	// root, rather than mutating a process-wide default that a concurrent
+	// Unpack call (with a different Root) could race on.
+	callOpts := *opts
+	callOpts.Fetchers = fetchersFor(cache, opts.Fetchers)
+
+	mergedDir, err := mergeDir(root, opts)
+	if err != nil {
+		return "", fmt.Errorf("snapshot: unable to create merge dir: %w", err)
+	}
+
+	if opts.Exclusive {
+		// Hold this lock across both the empty check and the layer
+		// assembly below: otherwise two processes can both observe an
+		// empty mergedDir and both proceed to copyTree into it.
+		unlockRoot, err := lockPath(ctx, filepath.Join(cache, "root"+lockSuffix))
+		if err != nil {
+			return "", err
+		}
+		defer unlockRoot()
+
+		if empty, err := dirIsEmpty(mergedDir); err != nil {
+			return "", err
+		} else if !empty {
+			// Some other ghw process already unpacked into this exclusive
+			// directory; leave its content untouched.
+			logger.Debugf("snapshot: reusing exclusive merge dir %s", mergedDir)
+			return mergedDir, nil
+		}
+	}
+
+	for _, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		logger.Debugf("snapshot: unpacking layer %s", layer)
+		layerDir, err := unpackLayer(ctx, cache, layer, &callOpts)
+		if err != nil {
+			return "", err
+		}
+		if err := copyTree(layerDir, mergedDir); err != nil {
+			return "", fmt.Errorf("snapshot: unable to merge layer %q: %w", layer, err)
+		}
+	}
+
+	logger.Infof("snapshot: unpacked %d layer(s) into %s", len(layers), mergedDir)
+	return mergedDir, nil
+}
+
+// contextAndLogger returns opt.Context and opt.Logger, defaulting to
+// context.Background() and option.NopLogger respectively for an opt that
+// wasn't built via option.Merge.
+func contextAndLogger(opt *option.Option) (context.Context, option.Logger) {
+	ctx := opt.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	logger := opt.Logger
+	if logger == nil {
+		logger = option.NopLogger
+	}
+	return ctx, logger
+}
+
+// snapshotRoot returns the base working directory for this Unpack call:
+// opts.Root if the caller supplied one, else the system temp directory.
+func snapshotRoot(opts *option.SnapshotOptions) string {
+	if opts.Root != nil && *opts.Root != "" {
+		return *opts.Root
+	}
+	return os.TempDir()
+}
+
+// cacheRoot returns the directory layer and ref bookkeeping (the content
+// cache, ref locks, HTTP ETags) lives under. When the caller didn't supply a
+// Root, this is just root itself, since mergeDir already puts the merged
+// tree in its own fresh subdirectory of root, separate from the cache.
+// When the caller did supply a Root, though, mergeDir unpacks directly into
+// root - and root is what ghw goes on to chroot into - so the cache must
+// live in a sibling directory instead, or its "layers", "refs" and "raw"
+// subdirectories would leak into the consumed sysfs tree.
+func cacheRoot(root string, opts *option.SnapshotOptions) string {
+	if opts.Root != nil && *opts.Root != "" {
+		return filepath.Clean(root) + ".ghw-cache"
+	}
+	return root
+}
+
+// mergeDir returns the directory the layers should be merged into: root
+// itself if the caller supplied a Root (so they can manage and, with
+// Exclusive, share it across processes), or else a fresh temporary
+// directory under root.
+func mergeDir(root string, opts *option.SnapshotOptions) (string, error) {
+	if opts.Root != nil && *opts.Root != "" {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return "", err
+		}
+		return root, nil
+	}
+	return os.MkdirTemp(root, "ghw-snapshot-merged-")
+}
+
+// dirIsEmpty returns whether dir contains no entries.
+func dirIsEmpty(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
+
+// Cleanup removes mergedDir, the directory returned by Unpack, unless
+// opts.Preserve is set, in which case it is left in place for inspection.
+// Layer cache directories (see cacheRoot) are never removed by Cleanup: they are
+// content-addressed and intentionally shared across ghw invocations.
+func Cleanup(mergedDir string, opts *option.SnapshotOptions) error {
+	if opts != nil && opts.Preserve {
+		return nil
+	}
+	return os.RemoveAll(mergedDir)
+}
+
+// unpackLayer fetches and unpacks a single layer (a bare path, or a
+// scheme-qualified reference such as http(s):// or oci://) into a
+// content-addressed directory under root, reusing it if it is already
+// present, and returns that directory's path.
+//
+// Fetched bytes are streamed directly into the tar extractor; unpackLayer
+// itself writes no whole-file copy of them unless opts.Preserve is set, in
+// which case a copy of the raw (pre-extraction) bytes is also kept under
+// root for inspection. The built-in http(s) fetcher does keep its own
+// cached copy of each body it downloads, for If-None-Match revalidation.
+//
+// A lock keyed on ref (not on the content hash, which isn't known until the
+// ref has been fetched) is held for the duration of the fetch-and-extract,
+// so that two ghw processes asked to unpack the same ref at the same time
+// don't both fetch and extract it: the second one blocks on the lock and
+// then finds the ref already resolved to a populated layer directory.
+func unpackLayer(ctx context.Context, root string, ref string, opts *option.SnapshotOptions) (string, error) {
+	refDir := filepath.Join(root, "refs")
+	if err := os.MkdirAll(refDir, 0755); err != nil {
+		return "", err
+	}
+	refHash := sha256hex([]byte(ref))
+	refMapPath := filepath.Join(refDir, refHash)
+
+	unlock, err := lockPath(ctx, refMapPath+lockSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if contentHash, err := os.ReadFile(refMapPath); err == nil {
+		layerDir := filepath.Join(root, "layers", string(contentHash))
+		if _, err := os.Stat(layerDir); err == nil {
+			return layerDir, nil
+		}
+	}
+
+	fetcher, err := fetcherFor(opts, schemeOf(ref))
+	if err != nil {
+		return "", fmt.Errorf("snapshot: unable to fetch layer %q: %w", ref, err)
+	}
+	rc, err := fetcher.Fetch(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("snapshot: unable to fetch layer %q: %w", ref, err)
+	}
+	defer rc.Close()
+
+	var body io.Reader = rc
+	if opts != nil && opts.Preserve {
+		rawDir := filepath.Join(root, "raw")
+		if err := os.MkdirAll(rawDir, 0755); err != nil {
+			return "", err
+		}
+		raw, err := os.Create(filepath.Join(rawDir, refHash))
+		if err != nil {
+			return "", err
+		}
+		defer raw.Close()
+		body = io.TeeReader(body, raw)
+	}
+
+	h := sha256.New()
+	body = io.TeeReader(body, h)
+
+	tmpDir, err := os.MkdirTemp(root, "layer-unpack-")
+	if err != nil {
+		return "", fmt.Errorf("snapshot: unable to create unpack dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := extractTarTo(ctx, body, tmpDir); err != nil {
+		return "", fmt.Errorf("snapshot: unable to extract layer %q: %w", ref, err)
+	}
+	// extractTarTo stops at the tar end-of-archive marker; read whatever
+	// follows it (block padding, the gzip trailer) as well, so that the hash
+	// and any preserved raw copy cover the whole fetched stream.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return "", fmt.Errorf("snapshot: unable to read layer %q: %w", ref, err)
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	layerDir := filepath.Join(root, "layers", hash)
+	if err := os.MkdirAll(filepath.Dir(layerDir), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("snapshot: unable to finalize unpack dir %q: %w", layerDir, err)
+		}
+		// Another ghw process unpacked this exact content first; reuse it.
+	}
+
+	if err := os.WriteFile(refMapPath, []byte(hash), 0644); err != nil {
+		return "", fmt.Errorf("snapshot: unable to record ref %q: %w", ref, err)
+	}
+
+	return layerDir, nil
+}
+
+// sha256hex returns the hex-encoded sha256 of b.
+func sha256hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// gzipMagic is the two leading bytes of a gzip stream (RFC 1952 2.3.1).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// extractTarTo extracts the (optionally gzip-compressed) tar stream r into
+// destDir. ctx is checked between entries so that cancelling a probe stuck
+// unpacking a large tree doesn't have to wait for the whole tarball.
+//
+// Layers may come from an untrusted http(s) or oci:// remote, so each
+// entry's name is resolved against destDir and rejected if it would escape
+// it (directly via "../" segments, or by writing through a symlink planted
+// by an earlier entry in the same tarball) before anything is written.
+func extractTarTo(ctx context.Context, r io.Reader, destDir string) error {
+	// gzip.NewReader consumes several bytes of r parsing the header before
+	// returning ErrHeader on non-gzip input, so probing it directly and
+	// falling back to r on failure (as a naive "try gzip, else plain tar"
+	// would) corrupts a plain tar stream. Peek the magic bytes first instead
+	// so a non-gzip r is handed to tar.NewReader untouched.
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("snapshot: invalid gzip stream: %w", err)
+		}
+		defer gzr.Close()
+		r = gzr
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := sanitizedJoin(destDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if throughSymlink, err := hasSymlinkComponent(destDir, target); err != nil {
+			return err
+		} else if throughSymlink {
+			return fmt.Errorf("snapshot: tar entry %q writes through a symlink", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("snapshot: tar entry %q writes through a symlink", hdr.Name)
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+}
+
+// sanitizedJoin joins destDir and name, rejecting any result that would
+// escape destDir once cleaned - e.g. a tar entry named "../../etc/passwd".
+func sanitizedJoin(destDir, name string) (string, error) {
+	target := filepath.Join(destDir, name)
+	if target != destDir && !strings.HasPrefix(target, destDir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("snapshot: tar entry %q escapes destination directory", name)
+	}
+	return target, nil
+}
+
+// hasSymlinkComponent reports whether any path component strictly between
+// destDir and target is a symlink. A tarball that first plants a symlink
+// and then writes an entry through it (e.g. "link" then "link/evil") would
+// otherwise escape destDir despite each individual name passing
+// sanitizedJoin.
+func hasSymlinkComponent(destDir, target string) (bool, error) {
+	rel, err := filepath.Rel(destDir, filepath.Dir(target))
+	if err != nil {
+		return false, err
+	}
+	dir := destDir
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// copyTree copies the contents of srcDir over destDir, overwriting any
+// files that already exist at the destination so that later layers shadow
+// earlier ones. A whiteout marker (see Diff) removes the entry it names
+// from destDir instead of being copied itself.
+func copyTree(srcDir, destDir string) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		dir, base := filepath.Split(rel)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target := filepath.Join(destDir, dir, strings.TrimPrefix(base, whiteoutPrefix))
+			return os.RemoveAll(target)
+		}
+		target := filepath.Join(destDir, rel)
+		// An entry of another kind already at target (a file where this
+		// layer has a directory or the reverse, or a symlink that writing a
+		// file would follow) is removed first, so this layer's entry
+		// replaces it.
+		if existing, err := os.Lstat(target); err == nil &&
+			(existing.IsDir() != info.IsDir() || existing.Mode()&os.ModeSymlink != 0) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode())
+		case info.Mode()&os.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(linkTarget, target)
+		default:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+			_, err = io.Copy(out, in)
+			return err
+		}
+	})
+}